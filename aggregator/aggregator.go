@@ -18,6 +18,9 @@ limitations under the License.
 package aggregator
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -26,14 +29,29 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/hashicorp/nomad/api"
+	outputs "github.com/nomad-node-problem-detector/outputs"
 	types "github.com/nomad-node-problem-detector/types"
 	"github.com/urfave/cli/v2"
 )
 
+// streamReadBufferSize bounds the per-connection read buffer used when
+// consuming a detector's /v1/nodehealth/stream. Some grpc-websocket-proxy
+// deployments in the historical stack capped message framing at 64 KiB by
+// default; size this explicitly so a single large health check message is
+// never truncated.
+const streamReadBufferSize = 1 << 20 // 1 MiB
+
+// streamMinBackoff and streamMaxBackoff bound the reconnect backoff used by
+// the stream transport when a detector connection drops.
+const streamMinBackoff = 1 * time.Second
+const streamMaxBackoff = 30 * time.Second
+
 var AggregatorCommand = &cli.Command{
 	Name:  "aggregator",
 	Usage: "Run npd in aggregator mode",
@@ -56,6 +74,34 @@ var AggregatorCommand = &cli.Command{
 			Value:   "http://localhost:4646",
 			Usage:   "HTTP API address of a Nomad server or agent.",
 		},
+		&cli.StringFlag{
+			Name:  "transport",
+			Value: "poll",
+			Usage: "How to retrieve node health from the detector: \"poll\" or \"stream\"",
+		},
+		&cli.StringFlag{
+			Name:    "config",
+			Aliases: []string{"c"},
+			Usage:   "Path to an aggregator config file declaring \"outputs\", \"safety\", and \"drain\" sections",
+		},
+		&cli.StringFlag{
+			Name:  "ha-backend",
+			Usage: "Coordinate leadership across aggregator replicas using \"etcd\", \"consul\", or \"nomad-lock\". Unset runs a single always-leader aggregator.",
+		},
+		&cli.StringFlag{
+			Name:  "ha-endpoints",
+			Usage: "Comma-separated etcd or Consul addresses for --ha-backend. Unused for \"nomad-lock\", which reuses --nomad-server.",
+		},
+		&cli.StringFlag{
+			Name:  "ha-port",
+			Value: ":8084",
+			Usage: "Port the /v1/leader endpoint listens on when --ha-backend is set",
+		},
+		&cli.StringFlag{
+			Name:  "drains-port",
+			Value: ":8085",
+			Usage: "Port the /v1/drains endpoint listens on",
+		},
 	},
 	Action: func(c *cli.Context) error {
 		return aggregate(c)
@@ -64,6 +110,45 @@ var AggregatorCommand = &cli.Command{
 
 var pause bool
 
+// config is the "outputs" section of the aggregator's optional --config
+// file. The same file's "safety" and "drain" sections are parsed separately,
+// by newSafetyPolicy and loadDrainConfig.
+type config struct {
+	Outputs []outputs.Config `json:"outputs"`
+}
+
+// loadSinks reads and initializes the output sinks declared in an aggregator
+// config file. An empty path is not an error; it just means no sinks are
+// configured.
+func loadSinks(configPath string) ([]outputs.Sink, error) {
+	if configPath == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	return outputs.Load(cfg.Outputs)
+}
+
+// writeToSinks fans a node's current health checks out to every configured
+// output sink, logging (rather than failing the aggregation loop on) any
+// individual sink error.
+func writeToSinks(sinks []outputs.Sink, nodeID string, checks []types.HealthCheck) {
+	for _, sink := range sinks {
+		if err := sink.Write(nodeID, checks); err != nil {
+			log.Warning(fmt.Sprintf("Error writing node %s health to output sink %s: %v\n", nodeID, sink.Name(), err))
+		}
+	}
+}
+
 func aggregate(context *cli.Context) error {
 	nomadServer := context.String("nomad-server")
 	client, err := getNomadClient(nomadServer)
@@ -71,6 +156,23 @@ func aggregate(context *cli.Context) error {
 		return err
 	}
 
+	sinks, err := loadSinks(context.String("config"))
+	if err != nil {
+		return err
+	}
+
+	safety, err := newSafetyPolicy(context.String("config"))
+	if err != nil {
+		return err
+	}
+
+	drainCfg, err := loadDrainConfig(context.String("config"))
+	if err != nil {
+		return err
+	}
+	drains := newDrainManager(drainCfg)
+	go serveDrains(context.String("drains-port"), drains)
+
 	aggregationCycleTime, err := time.ParseDuration(context.String("aggregation-cycle-time"))
 	if err != nil {
 		return err
@@ -80,9 +182,36 @@ func aggregate(context *cli.Context) error {
 
 	authToken := os.Getenv("DETECTOR_HTTP_TOKEN")
 
+	transport := context.String("transport")
+	if transport != "poll" && transport != "stream" {
+		return fmt.Errorf("unsupported transport %q, must be \"poll\" or \"stream\"", transport)
+	}
+
+	var elector leaderElector
+	isLeader := &boolFlag{value: true}
+	if haBackendName := context.String("ha-backend"); haBackendName != "" {
+		var endpoints []string
+		if raw := context.String("ha-endpoints"); raw != "" {
+			endpoints = strings.Split(raw, ",")
+		}
+
+		elector, err = newLeaderElector(haBackendName, endpoints, client)
+		if err != nil {
+			return err
+		}
+
+		var stop func()
+		isLeader, stop = startLeaderElection(elector, context.String("ha-port"))
+		defer stop()
+	}
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGUSR1)
-	go flipPause(sigs)
+	go flipPause(sigs, elector)
+
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go reloadSafetyPolicy(hups, safety)
 
 	nodeHandle := client.Nodes()
 
@@ -90,12 +219,25 @@ func aggregate(context *cli.Context) error {
 
 	// map[nodeID][node health check /v1/nodehealth/]
 	m := make(map[string][]types.HealthCheck)
+	var mLock sync.Mutex
+
+	// streaming tracks which nodes already have a /v1/nodehealth/stream
+	// subscription goroutine running, so the aggregation loop only starts
+	// one per node even as List() keeps returning it every cycle.
+	streaming := make(map[string]bool)
+
 	for {
-		if pause {
+		if isPausedNow(elector) {
 			// Aggregator is paused. Wait for unpause.
 			continue
 		}
 
+		if !isLeader.get() {
+			// Standing by; another replica holds leadership.
+			time.Sleep(aggregationCycleTime)
+			continue
+		}
+
 		log.Info("Collect and aggregate nodes health")
 		nodes, _, err := nodeHandle.List(queryOptions)
 		if err != nil {
@@ -104,6 +246,9 @@ func aggregate(context *cli.Context) error {
 			time.Sleep(aggregationCycleTime)
 			continue
 		}
+		safety.refresh(nodeHandle, nodes)
+		drains.refresh(nodeHandle, nodes)
+		cycleIsResync := resyncing.get()
 
 		for _, node := range nodes {
 			npdServer := fmt.Sprintf("http://%s%s", node.Address, detectorPort)
@@ -118,7 +263,15 @@ func aggregate(context *cli.Context) error {
 			if !npdActive {
 				errMsg := fmt.Sprintf("Node %s is unhealthy, marking it as ineligible.", node.Address)
 				log.Warning(errMsg)
-				toggleNodeEligibility(nodeHandle, node.ID, node.Address, false)
+				drains.apply(nodeHandle, node, "detector-unreachable", safety)
+				continue
+			}
+
+			if transport == "stream" {
+				if !streaming[node.ID] {
+					streaming[node.ID] = true
+					go streamNodeHealth(nodeHandle, node, npdServer, authToken, m, &mLock, sinks, safety, drains)
+				}
 				continue
 			}
 
@@ -162,53 +315,201 @@ func aggregate(context *cli.Context) error {
 				continue
 			}
 
-			var nodeHealth []types.HealthCheck
-			if m[node.ID] != nil {
-				nodeHealth = m[node.ID]
+			mLock.Lock()
+			previousChecks := m[node.ID]
+			mLock.Unlock()
+
+			applyHealthUpdate(nodeHandle, node, previousChecks, current, safety, drains)
+			writeToSinks(sinks, node.ID, current)
+
+			mLock.Lock()
+			m[node.ID] = current
+			mLock.Unlock()
+		}
+
+		if cycleIsResync {
+			resyncing.set(false)
+		}
+		time.Sleep(aggregationCycleTime)
+	}
+	return nil
+}
+
+// applyHealthUpdate compares a node's previous health checks against its
+// current ones and, if a check's result changed (or the node has no previous
+// checks, or has a transition the safety policy deferred), applies the
+// configured response of the most severe unhealthy check via drains.apply,
+// or rolls the node back via drains.recover if every check is healthy. It is
+// shared by both the poll and stream transports.
+func applyHealthUpdate(nodeHandle *api.Nodes, node *api.NodeListStub, previousChecks, current []types.HealthCheck, safety *safetyPolicy, drains *drainManager) {
+	previous := make(map[string]types.HealthCheck)
+	for _, nh := range previousChecks {
+		previous[nh.Type] = nh
+	}
+
+	nodeHealthy := true
+	stateChanged := false
+	worstCheck := ""
+	worstSeverity := -1
+
+	for _, curr := range current {
+		// Default CPU, memory and disk checks are represented with
+		// boolean (true/false). curr.Result = true for CPUUnderPressure
+		// or MemoryUnderPressure or DiskUsageHigh tells that the system
+		// is under CPU/memory/disk pressure and should be taken out of
+		// eligibility.
+		if curr.Result == "Unhealthy" || curr.Result == "true" {
+			errMsg := fmt.Sprintf("Node %s: %s is %s\n", node.Address, curr.Type, curr.Result)
+			log.Warning(errMsg)
+			nodeHealthy = false
+
+			if severity := responseSeverity(drains.responseFor(curr.Type)); severity > worstSeverity {
+				worstSeverity = severity
+				worstCheck = curr.Type
 			}
+		}
 
-			previous := make(map[string]types.HealthCheck)
-			for _, nh := range nodeHealth {
-				previous[nh.Type] = nh
+		prev, ok := previous[curr.Type]
+		if ok {
+			if prev.Result == curr.Result {
+				continue
+			} else {
+				stateChanged = true
 			}
+		}
+	}
 
-			nodeHealthy := true
-			stateChanged := false
-
-			for _, curr := range current {
-				// Default CPU, memory and disk checks are represented with
-				// boolean (true/false). curr.Result = true for CPUUnderPressure
-				// or MemoryUnderPressure or DiskUsageHigh tells that the system
-				// is under CPU/memory/disk pressure and should be taken out of
-				// eligibility.
-				if curr.Result == "Unhealthy" || curr.Result == "true" {
-					errMsg := fmt.Sprintf("Node %s: %s is %s\n", node.Address, curr.Type, curr.Result)
-					log.Warning(errMsg)
-					nodeHealthy = false
-				}
+	// A node whose ineligible/drain transition the safety policy deferred
+	// stays unhealthy with an unchanged result cycle to cycle, so
+	// stateChanged alone would never retry it; isDeferred keeps it under
+	// consideration until the policy lets it through or it recovers.
+	retryDeferred := !nodeHealthy && safety.isDeferred(node.ID)
+
+	if len(previous) == 0 || stateChanged || retryDeferred {
+		if nodeHealthy {
+			drains.recover(nodeHandle, node, safety)
+		} else {
+			drains.apply(nodeHandle, node, worstCheck, safety)
+		}
+	}
+}
 
-				prev, ok := previous[curr.Type]
-				if ok {
-					if prev.Result == curr.Result {
-						continue
-					} else {
-						stateChanged = true
-					}
-				}
-			}
+// setNodeEligibility applies an eligibility transition, consulting the
+// safety policy first when marking a node ineligible. A node being made
+// eligible again is always allowed through and clears any deferred
+// ineligible transition recorded for it.
+func setNodeEligibility(nodeHandle *api.Nodes, node *api.NodeListStub, eligible bool, safety *safetyPolicy) {
+	if resyncing.get() {
+		log.Info(fmt.Sprintf("Suppressing eligibility change for node %s during post-failover resync\n", node.Address))
+		return
+	}
 
-			if len(previous) == 0 || stateChanged {
-				if nodeHealthy {
-					toggleNodeEligibility(nodeHandle, node.ID, node.Address, true)
+	if !eligible {
+		if !safety.allowIneligible(node) {
+			return
+		}
+	} else {
+		safety.clearDeferred(node.ID)
+	}
+	toggleNodeEligibility(nodeHandle, node.ID, node.Address, eligible)
+}
+
+// streamNodeHealth subscribes to a detector's /v1/nodehealth/stream and
+// applies each incoming health check update as it arrives, reconnecting with
+// exponential backoff if the connection drops. It runs for the lifetime of
+// the aggregator process once started for a node.
+func streamNodeHealth(nodeHandle *api.Nodes, node *api.NodeListStub, npdServer, authToken string, m map[string][]types.HealthCheck, mLock *sync.Mutex, sinks []outputs.Sink, safety *safetyPolicy, drains *drainManager) {
+	backoff := streamMinBackoff
+
+	for {
+		if err := consumeNodeHealthStream(nodeHandle, node, npdServer, authToken, m, mLock, sinks, safety, drains); err != nil {
+			log.Warning(fmt.Sprintf("Node %s: health stream disconnected, reconnecting in %s: %v\n", node.Address, backoff, err))
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > streamMaxBackoff {
+			backoff = streamMaxBackoff
+		}
+	}
+}
+
+// consumeNodeHealthStream opens a single /v1/nodehealth/stream connection and
+// reads newline-delimited types.HealthCheck events until the connection ends.
+// Each event updates the node's running set of checks and re-evaluates
+// eligibility, the same way a poll cycle would.
+func consumeNodeHealthStream(nodeHandle *api.Nodes, node *api.NodeListStub, npdServer, authToken string, m map[string][]types.HealthCheck, mLock *sync.Mutex, sinks []outputs.Sink, safety *safetyPolicy, drains *drainManager) error {
+	url := npdServer + "/v1/nodehealth/stream"
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	if authToken != "" {
+		base64EncodedToken := base64.StdEncoding.EncodeToString([]byte(authToken))
+		req.Header.Set("Authorization", "Basic "+base64EncodedToken)
+	}
+
+	// No client-side timeout: this is a long-lived connection, not a
+	// request/response call.
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+
+	reader := bufio.NewReaderSize(resp.Body, streamReadBufferSize)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			trimmed := bytes.TrimSpace(line)
+			if len(trimmed) > 0 {
+				var check types.HealthCheck
+				if jsonErr := json.Unmarshal(trimmed, &check); jsonErr != nil {
+					log.Warning(fmt.Sprintf("Node %s: error unmarshalling health stream event: %v\n", node.Address, jsonErr))
 				} else {
-					toggleNodeEligibility(nodeHandle, node.ID, node.Address, false)
+					mLock.Lock()
+					previousChecks := m[node.ID]
+					updated := mergeHealthCheck(previousChecks, check)
+					m[node.ID] = updated
+					mLock.Unlock()
+
+					applyHealthUpdate(nodeHandle, node, previousChecks, updated, safety, drains)
+					writeToSinks(sinks, node.ID, updated)
 				}
 			}
-			m[node.ID] = current
 		}
-		time.Sleep(aggregationCycleTime)
+		// A bare heartbeat frame is just "\n" and produces no trimmed
+		// content above; receiving it is enough to know the connection
+		// is still alive.
+		if err != nil {
+			return err
+		}
 	}
-	return nil
+}
+
+// mergeHealthCheck returns checks with the entry matching check.Type replaced
+// (or appended), leaving every other check untouched.
+func mergeHealthCheck(checks []types.HealthCheck, check types.HealthCheck) []types.HealthCheck {
+	updated := make([]types.HealthCheck, 0, len(checks)+1)
+	found := false
+	for _, c := range checks {
+		if c.Type == check.Type {
+			updated = append(updated, check)
+			found = true
+		} else {
+			updated = append(updated, c)
+		}
+	}
+	if !found {
+		updated = append(updated, check)
+	}
+	return updated
 }
 
 // Toggle Nomad node eligibility.
@@ -246,11 +547,29 @@ func isNpdServerActive(npdServer, authToken string) (bool, error) {
 	return true, nil
 }
 
-// flipPause pauses and unpauses aggregator based on receiving SIGUSR1 signal.
-func flipPause(sigs chan os.Signal) {
+// flipPause pauses and unpauses aggregator based on receiving SIGUSR1
+// signal. With an HA backend configured, the new pause state is
+// broadcast through it so every aggregator replica pauses together,
+// regardless of which one received the signal.
+func flipPause(sigs chan os.Signal, elector leaderElector) {
 	for {
 		select {
 		case <-sigs:
+			if elector != nil {
+				newPause := !elector.paused()
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := elector.setPaused(ctx, newPause); err != nil {
+					log.Warning(fmt.Sprintf("Error broadcasting pause state: %v\n", err))
+				}
+				cancel()
+				if newPause {
+					log.Info("Received signal SIGUSR1, broadcasting pause to all aggregator replicas.")
+				} else {
+					log.Info("Received signal SIGUSR1, broadcasting unpause to all aggregator replicas.")
+				}
+				continue
+			}
+
 			pause = !pause
 			if pause {
 				log.Info("Received signal SIGUSR1, pausing aggregator.")
@@ -261,6 +580,28 @@ func flipPause(sigs chan os.Signal) {
 	}
 }
 
+// isPausedNow reports whether the aggregation loop should currently be
+// paused, consulting the HA backend's broadcast pause flag if one is
+// configured and the local SIGUSR1 flag otherwise.
+func isPausedNow(elector leaderElector) bool {
+	if elector != nil {
+		return elector.paused()
+	}
+	return pause
+}
+
+// reloadSafetyPolicy re-reads the safety policy's config file each time
+// SIGHUP is received, so operators can retune per-domain limits without
+// restarting the aggregator.
+func reloadSafetyPolicy(sigs chan os.Signal, safety *safetyPolicy) {
+	for range sigs {
+		log.Info("Received signal SIGHUP, reloading safety policy.")
+		if err := safety.reload(); err != nil {
+			log.Warning(fmt.Sprintf("Error reloading safety policy: %v\n", err))
+		}
+	}
+}
+
 // Get Nomad HTTP client.
 // This client will be used to list nodes and toggle node eligibility.
 func getNomadClient(nomadServer string) (*api.Client, error) {
@@ -0,0 +1,57 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"testing"
+
+	types "github.com/nomad-node-problem-detector/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeHealthCheckReplacesMatchingType(t *testing.T) {
+	checks := []types.HealthCheck{
+		{Type: "CPUUnderPressure", Result: "false"},
+		{Type: "DiskUsageHigh", Result: "false"},
+	}
+
+	updated := mergeHealthCheck(checks, types.HealthCheck{Type: "DiskUsageHigh", Result: "true"})
+
+	assert.Len(t, updated, 2)
+	assert.Equal(t, "false", updated[0].Result)
+	assert.Equal(t, "true", updated[1].Result)
+}
+
+func TestMergeHealthCheckAppendsUnknownType(t *testing.T) {
+	checks := []types.HealthCheck{
+		{Type: "CPUUnderPressure", Result: "false"},
+	}
+
+	updated := mergeHealthCheck(checks, types.HealthCheck{Type: "MemoryUnderPressure", Result: "true"})
+
+	assert.Len(t, updated, 2)
+	assert.Equal(t, "CPUUnderPressure", updated[0].Type)
+	assert.Equal(t, "MemoryUnderPressure", updated[1].Type)
+}
+
+func TestMergeHealthCheckEmptyInput(t *testing.T) {
+	updated := mergeHealthCheck(nil, types.HealthCheck{Type: "CPUUnderPressure", Result: "false"})
+
+	assert.Len(t, updated, 1)
+	assert.Equal(t, "CPUUnderPressure", updated[0].Type)
+}
@@ -0,0 +1,290 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultDrainResponse is used for any health check with no entry in the
+// "drain" config section, preserving the historical behavior of simply
+// toggling eligibility.
+const defaultDrainResponse = "ineligible"
+
+// forceDrainDeadline is the UpdateDrain deadline used for a "drain-force"
+// response: short enough that Nomad force-stops remaining allocations
+// almost immediately, mirroring `nomad node drain -force`.
+const forceDrainDeadline = 1 * time.Second
+
+// drainConfig is the "drain" section of the aggregator config file. It
+// maps a health check's Type to the response it should provoke while
+// unhealthy: "ineligible", "drain:<duration>" (e.g. "drain:30m"),
+// "drain-force", or "notify-only". A check with no entry falls back to
+// DefaultResponse.
+type drainConfig struct {
+	Responses       map[string]string `json:"responses"`
+	DefaultResponse string            `json:"default_response"`
+}
+
+// loadDrainConfig reads the "drain" section of an aggregator config file.
+// An empty path, or a file with no "drain" section, yields a config that
+// responds to every check with the historical "ineligible" behavior.
+func loadDrainConfig(configPath string) (drainConfig, error) {
+	cfg := drainConfig{DefaultResponse: defaultDrainResponse}
+	if configPath == "" {
+		return cfg, nil
+	}
+
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return cfg, err
+	}
+
+	wrapper := struct {
+		Drain drainConfig `json:"drain"`
+	}{Drain: cfg}
+	if err := json.Unmarshal(data, &wrapper); err != nil {
+		return cfg, err
+	}
+	cfg = wrapper.Drain
+	if cfg.DefaultResponse == "" {
+		cfg.DefaultResponse = defaultDrainResponse
+	}
+	return cfg, nil
+}
+
+// responseSeverity ranks drain responses so applyHealthUpdate can pick the
+// strongest one when several health checks are unhealthy at once.
+func responseSeverity(response string) int {
+	switch {
+	case response == "drain-force":
+		return 3
+	case response == "ineligible":
+		return 2
+	case strings.HasPrefix(response, "drain:"):
+		return 1
+	default: // "notify-only" or unrecognized
+		return 0
+	}
+}
+
+// drainIntent records a drain the aggregator started (or, after a restart
+// or HA failover, rediscovered already in progress via Nomad's own
+// DrainStrategy), so it can be reported over /v1/drains and rolled back
+// if the node recovers before the deadline.
+type drainIntent struct {
+	NodeID      string    `json:"node_id"`
+	NodeAddress string    `json:"node_address"`
+	Check       string    `json:"check"`
+	Force       bool      `json:"force"`
+	Deadline    time.Time `json:"deadline"`
+}
+
+// drainManager decides how the aggregator should respond to an unhealthy
+// node based on which health check is failing - toggling eligibility,
+// starting a graceful or forced Nomad drain, or just notifying - and
+// tracks drains currently in progress.
+type drainManager struct {
+	config drainConfig
+
+	lock   sync.Mutex
+	active map[string]*drainIntent
+}
+
+func newDrainManager(config drainConfig) *drainManager {
+	return &drainManager{config: config, active: make(map[string]*drainIntent)}
+}
+
+// responseFor returns the configured response for a health check type.
+func (d *drainManager) responseFor(checkType string) string {
+	if response, ok := d.config.Responses[checkType]; ok {
+		return response
+	}
+	return d.config.DefaultResponse
+}
+
+// refresh reconciles the active drain map against the DrainStrategy Nomad
+// reports for each node. This is what lets drain intents survive an
+// aggregator restart (or failover to a standby, under the HA backend)
+// without a local persistence store: Nomad's node state is already the
+// durable record of which nodes are draining. *api.NodeListStub (what
+// List() returns) only reports whether a node is draining via its Drain
+// bool, not the strategy's ForceDeadline, so nodeHandle is used to fetch the
+// full api.Node for any newly-seen draining node.
+func (d *drainManager) refresh(nodeHandle *api.Nodes, nodes []*api.NodeListStub) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	seen := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		if !node.Drain {
+			continue
+		}
+		seen[node.ID] = true
+		if _, tracked := d.active[node.ID]; tracked {
+			continue
+		}
+
+		full, _, err := nodeHandle.Info(node.ID, nil)
+		if err != nil || full.DrainStrategy == nil {
+			log.Warning(fmt.Sprintf("Error fetching drain strategy for node %s, will retry next cycle: %v\n", node.Address, err))
+			continue
+		}
+
+		d.active[node.ID] = &drainIntent{
+			NodeID:      node.ID,
+			NodeAddress: node.Address,
+			Check:       "unknown (drain recovered after restart)",
+			Deadline:    full.DrainStrategy.ForceDeadline,
+		}
+	}
+
+	for nodeID := range d.active {
+		if !seen[nodeID] {
+			delete(d.active, nodeID)
+		}
+	}
+}
+
+// snapshot returns every drain intent currently tracked, for /v1/drains.
+func (d *drainManager) snapshot() []drainIntent {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	intents := make([]drainIntent, 0, len(d.active))
+	for _, intent := range d.active {
+		intents = append(intents, *intent)
+	}
+	return intents
+}
+
+// apply responds to node being unhealthy because of checkType, per that
+// check's configured response.
+func (d *drainManager) apply(nodeHandle *api.Nodes, node *api.NodeListStub, checkType string, safety *safetyPolicy) {
+	response := d.responseFor(checkType)
+
+	switch {
+	case response == "notify-only":
+		return
+	case response == "drain-force":
+		d.startDrain(nodeHandle, node, checkType, forceDrainDeadline, safety)
+	case strings.HasPrefix(response, "drain:"):
+		deadline, err := time.ParseDuration(strings.TrimPrefix(response, "drain:"))
+		if err != nil {
+			log.Warning(fmt.Sprintf("Invalid drain deadline %q for check %s, falling back to ineligible: %v\n", response, checkType, err))
+			setNodeEligibility(nodeHandle, node, false, safety)
+			return
+		}
+		d.startDrain(nodeHandle, node, checkType, deadline, safety)
+	default: // "ineligible" or unrecognized
+		setNodeEligibility(nodeHandle, node, false, safety)
+	}
+}
+
+// recover rolls node back to eligible because its health checks recovered,
+// cancelling any drain the aggregator tracks for it before its deadline
+// expired. Like setNodeEligibility, the cancellation is suppressed during
+// the post-failover resync cycle so a freshly-elected leader doesn't act on
+// drain state it hasn't finished reconciling yet.
+func (d *drainManager) recover(nodeHandle *api.Nodes, node *api.NodeListStub, safety *safetyPolicy) {
+	d.lock.Lock()
+	_, draining := d.active[node.ID]
+	d.lock.Unlock()
+
+	if draining {
+		if resyncing.get() {
+			log.Info(fmt.Sprintf("Suppressing drain cancellation for node %s during post-failover resync\n", node.Address))
+			return
+		}
+
+		d.lock.Lock()
+		delete(d.active, node.ID)
+		d.lock.Unlock()
+
+		if _, err := nodeHandle.UpdateDrain(node.ID, nil, true, nil); err != nil {
+			log.Warning(fmt.Sprintf("Error cancelling drain for recovered node %s: %v\n", node.Address, err))
+		}
+		safety.clearDeferred(node.ID)
+		return
+	}
+
+	setNodeEligibility(nodeHandle, node, true, safety)
+}
+
+// startDrain calls Nomad's UpdateDrain to begin draining node and records
+// the resulting intent. Starting a drain takes the node out of the
+// scheduling pool just as marking it ineligible does, so it is gated by the
+// same safety policy and post-failover resync suppression as
+// setNodeEligibility.
+func (d *drainManager) startDrain(nodeHandle *api.Nodes, node *api.NodeListStub, checkType string, deadline time.Duration, safety *safetyPolicy) {
+	if resyncing.get() {
+		log.Info(fmt.Sprintf("Suppressing drain for node %s during post-failover resync\n", node.Address))
+		return
+	}
+	if !safety.allowIneligible(node) {
+		return
+	}
+
+	spec := &api.DrainSpec{
+		Deadline:         deadline,
+		IgnoreSystemJobs: true,
+	}
+
+	if _, err := nodeHandle.UpdateDrain(node.ID, spec, false, nil); err != nil {
+		log.Warning(fmt.Sprintf("Error draining node %s for check %s: %v\n", node.Address, checkType, err))
+		return
+	}
+
+	intent := &drainIntent{
+		NodeID:      node.ID,
+		NodeAddress: node.Address,
+		Check:       checkType,
+		Force:       deadline <= forceDrainDeadline,
+		Deadline:    time.Now().Add(deadline),
+	}
+
+	d.lock.Lock()
+	d.active[node.ID] = intent
+	d.lock.Unlock()
+
+	log.Warning(fmt.Sprintf("Node %s: draining (force=%v, deadline=%s) due to %s\n", node.Address, intent.Force, deadline, checkType))
+}
+
+// serveDrains runs an HTTP server exposing every drain intent this
+// aggregator is currently tracking, at /v1/drains.
+func serveDrains(addr string, drains *drainManager) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/drains", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(drains.snapshot())
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	if err := server.ListenAndServe(); err != nil {
+		log.Warning(fmt.Sprintf("Error serving /v1/drains: %v\n", err))
+	}
+}
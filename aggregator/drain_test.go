@@ -0,0 +1,49 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseSeverity(t *testing.T) {
+	assert.Equal(t, 3, responseSeverity("drain-force"))
+	assert.Equal(t, 2, responseSeverity("ineligible"))
+	assert.Equal(t, 1, responseSeverity("drain:30m"))
+	assert.Equal(t, 0, responseSeverity("notify-only"))
+	assert.Equal(t, 0, responseSeverity("unrecognized"))
+}
+
+func TestResponseFor(t *testing.T) {
+	d := newDrainManager(drainConfig{
+		Responses:       map[string]string{"DiskUsageHigh": "drain:30m"},
+		DefaultResponse: defaultDrainResponse,
+	})
+
+	assert.Equal(t, "drain:30m", d.responseFor("DiskUsageHigh"))
+	assert.Equal(t, defaultDrainResponse, d.responseFor("CPUUnderPressure"))
+}
+
+func TestLoadDrainConfigDefaults(t *testing.T) {
+	cfg, err := loadDrainConfig("")
+	assert.Nil(t, err)
+	assert.Equal(t, defaultDrainResponse, cfg.DefaultResponse)
+	assert.Empty(t, cfg.Responses)
+}
@@ -0,0 +1,522 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	consulapi "github.com/hashicorp/consul/api"
+	nomadapi "github.com/hashicorp/nomad/api"
+	etcdclient "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// leaderLockKey is the lock/session name every aggregator replica
+// campaigns on, regardless of backend.
+const leaderLockKey = "nnpd/aggregator/leader"
+
+// leaderSessionTTL bounds how long a dead leader's lock is held before a
+// standby can take over, and so bounds the failover window described in
+// the HA design: a leader that stops renewing is replaced within roughly
+// one TTL.
+const leaderSessionTTL = 15 * time.Second
+
+// haRetryInterval is how long a replica waits before retrying a failed
+// campaign attempt (backend unreachable, session lost, etc).
+const haRetryInterval = 5 * time.Second
+
+// resyncing is set for one aggregation cycle right after this process
+// acquires leadership. While it's set, setNodeEligibility suppresses
+// eligibility changes so a freshly-elected leader's empty state map isn't
+// mistaken for every node having just changed health, per the HA design's
+// "first cycle after election is a full resync" rule.
+var resyncing boolFlag
+
+// boolFlag is a small atomic bool, used in place of sync/atomic's int32
+// dance wherever a flag needs to be read and written from multiple
+// goroutines (the aggregation loop, the election callback, signal
+// handlers).
+type boolFlag struct {
+	lock  sync.RWMutex
+	value bool
+}
+
+func (f *boolFlag) set(v bool) {
+	f.lock.Lock()
+	f.value = v
+	f.lock.Unlock()
+}
+
+func (f *boolFlag) get() bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.value
+}
+
+// leaderElector coordinates aggregator leadership across one of the
+// supported HA backends (etcd, Consul, or a Nomad-native lock). Only the
+// elected leader runs the aggregate() loop; standbys wait for the leader
+// to lose or release the lock.
+type leaderElector interface {
+	// run campaigns for leadership and keeps renewing it for as long as
+	// ctx is alive, sending true on changes each time this process
+	// becomes leader and false each time it loses leadership. changes is
+	// closed once ctx is done.
+	run(ctx context.Context) (changes <-chan bool)
+
+	// setPaused broadcasts the fleet-wide pause flag to every aggregator
+	// replica sharing this backend, so SIGUSR1 delivered to any one
+	// replica pauses them all.
+	setPaused(ctx context.Context, paused bool) error
+
+	// paused reports the last-observed fleet-wide pause flag.
+	paused() bool
+}
+
+// newLeaderElector constructs the leaderElector for the requested backend.
+func newLeaderElector(backend string, endpoints []string, nomadClient *nomadapi.Client) (leaderElector, error) {
+	switch backend {
+	case "etcd":
+		return newEtcdElector(endpoints)
+	case "consul":
+		return newConsulElector(endpoints)
+	case "nomad-lock":
+		return newNomadLockElector(nomadClient), nil
+	default:
+		return nil, fmt.Errorf("unsupported ha-backend %q, must be \"etcd\", \"consul\", or \"nomad-lock\"", backend)
+	}
+}
+
+// startLeaderElection starts backend's campaign loop and the /v1/leader
+// status endpoint, returning the shared isLeader flag the aggregation
+// loop should consult and a stop function the caller should defer.
+func startLeaderElection(backend leaderElector, leaderPort string) (isLeader *boolFlag, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	isLeader = &boolFlag{}
+	changes := backend.run(ctx)
+	go trackLeadership(changes, isLeader)
+	go serveLeaderStatus(leaderPort, isLeader)
+
+	return isLeader, cancel
+}
+
+// trackLeadership mirrors an elector's leadership changes into isLeader,
+// and marks the state map for a full resync whenever this process
+// transitions into leadership (startup included), per the HA design's
+// failover resync rule.
+func trackLeadership(changes <-chan bool, isLeader *boolFlag) {
+	for became := range changes {
+		isLeader.set(became)
+		if became {
+			resyncing.set(true)
+			log.Info("Acquired aggregator leadership.")
+		} else {
+			log.Info("Lost aggregator leadership, standing by.")
+		}
+	}
+}
+
+// hostname identifies this replica to the coordination backend, e.g. in
+// etcd election values or Consul lock session names. It's best-effort;
+// an empty hostname is harmless, it just makes "who is leader" debugging
+// less convenient.
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
+
+// ---- etcd backend ----------------------------------------------------
+
+type etcdElector struct {
+	client *etcdclient.Client
+
+	lock     sync.RWMutex
+	isPaused bool
+}
+
+func newEtcdElector(endpoints []string) (*etcdElector, error) {
+	client, err := etcdclient.New(etcdclient.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdElector{client: client}, nil
+}
+
+func (e *etcdElector) run(ctx context.Context) <-chan bool {
+	changes := make(chan bool, 1)
+	go e.campaignLoop(ctx, changes)
+	go e.watchPause(ctx)
+	return changes
+}
+
+func (e *etcdElector) campaignLoop(ctx context.Context, changes chan<- bool) {
+	defer close(changes)
+
+	for ctx.Err() == nil {
+		session, err := concurrency.NewSession(e.client,
+			concurrency.WithTTL(int(leaderSessionTTL.Seconds())),
+			concurrency.WithContext(ctx))
+		if err != nil {
+			log.Warning(fmt.Sprintf("Error starting etcd session, retrying in %s: %v\n", haRetryInterval, err))
+			time.Sleep(haRetryInterval)
+			continue
+		}
+
+		election := concurrency.NewElection(session, leaderLockKey)
+		if err := election.Campaign(ctx, hostname()); err != nil {
+			session.Close()
+			if ctx.Err() != nil {
+				return
+			}
+			log.Warning(fmt.Sprintf("Error campaigning for aggregator leadership, retrying in %s: %v\n", haRetryInterval, err))
+			time.Sleep(haRetryInterval)
+			continue
+		}
+
+		changes <- true
+		<-session.Done()
+		changes <- false
+		session.Close()
+	}
+}
+
+func (e *etcdElector) watchPause(ctx context.Context) {
+	for watchResp := range e.client.Watch(ctx, leaderLockKey+"/paused") {
+		for _, ev := range watchResp.Events {
+			e.lock.Lock()
+			e.isPaused = len(ev.Kv.Value) > 0 && string(ev.Kv.Value) == "true"
+			e.lock.Unlock()
+		}
+	}
+}
+
+func (e *etcdElector) setPaused(ctx context.Context, paused bool) error {
+	value := "false"
+	if paused {
+		value = "true"
+	}
+	_, err := e.client.Put(ctx, leaderLockKey+"/paused", value)
+	return err
+}
+
+func (e *etcdElector) paused() bool {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.isPaused
+}
+
+// ---- Consul backend ----------------------------------------------------
+
+type consulElector struct {
+	client *consulapi.Client
+
+	lock     sync.RWMutex
+	isPaused bool
+}
+
+func newConsulElector(endpoints []string) (*consulElector, error) {
+	cfg := consulapi.DefaultConfig()
+	if len(endpoints) > 0 && endpoints[0] != "" {
+		cfg.Address = endpoints[0]
+	}
+	client, err := consulapi.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &consulElector{client: client}, nil
+}
+
+func (c *consulElector) run(ctx context.Context) <-chan bool {
+	changes := make(chan bool, 1)
+	go c.campaignLoop(ctx, changes)
+	go c.watchPause(ctx)
+	return changes
+}
+
+func (c *consulElector) campaignLoop(ctx context.Context, changes chan<- bool) {
+	defer close(changes)
+
+	for ctx.Err() == nil {
+		lock, err := c.client.LockOpts(&consulapi.LockOptions{
+			Key:         leaderLockKey,
+			SessionName: fmt.Sprintf("nnpd-aggregator-%s", hostname()),
+			SessionTTL:  leaderSessionTTL.String(),
+		})
+		if err != nil {
+			log.Warning(fmt.Sprintf("Error creating Consul lock, retrying in %s: %v\n", haRetryInterval, err))
+			time.Sleep(haRetryInterval)
+			continue
+		}
+
+		stopCh := ctx.Done()
+		lostCh, err := lock.Lock(stopCh)
+		if err != nil {
+			log.Warning(fmt.Sprintf("Error acquiring Consul lock, retrying in %s: %v\n", haRetryInterval, err))
+			time.Sleep(haRetryInterval)
+			continue
+		}
+		if lostCh == nil {
+			// stopCh fired before the lock was acquired.
+			return
+		}
+
+		changes <- true
+		<-lostCh
+		changes <- false
+		lock.Unlock()
+	}
+}
+
+func (c *consulElector) watchPause(ctx context.Context) {
+	var lastIndex uint64
+	for ctx.Err() == nil {
+		kv, meta, err := c.client.KV().Get(leaderLockKey+"/paused", (&consulapi.QueryOptions{
+			WaitIndex: lastIndex,
+			WaitTime:  haRetryInterval,
+		}).WithContext(ctx))
+		if err != nil {
+			time.Sleep(haRetryInterval)
+			continue
+		}
+		lastIndex = meta.LastIndex
+
+		c.lock.Lock()
+		c.isPaused = kv != nil && string(kv.Value) == "true"
+		c.lock.Unlock()
+	}
+}
+
+func (c *consulElector) setPaused(ctx context.Context, paused bool) error {
+	value := []byte("false")
+	if paused {
+		value = []byte("true")
+	}
+	_, err := c.client.KV().Put(&consulapi.KVPair{Key: leaderLockKey + "/paused", Value: value}, nil)
+	return err
+}
+
+func (c *consulElector) paused() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.isPaused
+}
+
+// ---- nomad-lock backend ----------------------------------------------------
+
+// nomadLease is the payload stored in a Nomad Variable at leaderLockKey,
+// used to implement a lease-based lock without any additional
+// dependency beyond the Nomad API client the aggregator already has.
+type nomadLease struct {
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Paused    bool      `json:"paused"`
+}
+
+type nomadLockElector struct {
+	client *nomadapi.Client
+	holder string
+
+	lock     sync.RWMutex
+	isPaused bool
+}
+
+func newNomadLockElector(client *nomadapi.Client) *nomadLockElector {
+	return &nomadLockElector{client: client, holder: hostname()}
+}
+
+func (n *nomadLockElector) run(ctx context.Context) <-chan bool {
+	changes := make(chan bool, 1)
+	go n.campaignLoop(ctx, changes)
+	return changes
+}
+
+func (n *nomadLockElector) campaignLoop(ctx context.Context, changes chan<- bool) {
+	defer close(changes)
+
+	held := false
+	ticker := time.NewTicker(leaderSessionTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		lease, err := n.tryAcquireOrRenew(held)
+		switch {
+		case err != nil:
+			log.Warning(fmt.Sprintf("Error reaching Nomad lock variable, retrying in %s: %v\n", haRetryInterval, err))
+		case lease != nil:
+			n.lock.Lock()
+			n.isPaused = lease.Paused
+			n.lock.Unlock()
+
+			if lease.Holder == n.holder && !held {
+				held = true
+				changes <- true
+			} else if lease.Holder != n.holder && held {
+				held = false
+				changes <- false
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if held {
+				changes <- false
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tryAcquireOrRenew reads the current lease variable and, if it is
+// unheld, expired, or already held by this process, writes this process
+// in as (or keeps it as) the holder with a fresh expiry. It returns the
+// resulting lease, which may belong to another replica if this one lost
+// the race.
+func (n *nomadLockElector) tryAcquireOrRenew(currentlyHeld bool) (*nomadLease, error) {
+	variables := n.client.Variables()
+
+	existing, _, err := variables.Peek(leaderLockKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	lease := nomadLease{}
+	if existing != nil {
+		if raw, ok := existing.Items["lease"]; ok {
+			_ = json.Unmarshal([]byte(raw), &lease)
+		}
+	}
+
+	canTake := existing == nil || lease.Holder == "" || lease.Holder == n.holder || time.Now().After(lease.ExpiresAt)
+	if !canTake {
+		return &lease, nil
+	}
+
+	lease.Holder = n.holder
+	lease.ExpiresAt = time.Now().Add(leaderSessionTTL)
+
+	encoded, err := json.Marshal(lease)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &nomadapi.Variable{
+		Path:  leaderLockKey,
+		Items: nomadapi.VariableItems{"lease": string(encoded)},
+	}
+	if existing != nil {
+		v.ModifyIndex = existing.ModifyIndex
+		_, _, err = variables.CheckedUpdate(v, nil)
+	} else {
+		_, _, err = variables.Create(v, nil)
+	}
+	if err != nil {
+		// Someone else won the race to write this lease. lease.Holder is
+		// already n.holder at this point, so returning it as-is would
+		// make campaignLoop believe this replica won; re-fetch what was
+		// actually persisted instead.
+		return n.peekLease()
+	}
+
+	return &lease, nil
+}
+
+// peekLease reads the lease variable as currently persisted, without
+// attempting to acquire or renew it. A missing variable is reported as an
+// empty, unheld lease.
+func (n *nomadLockElector) peekLease() (*nomadLease, error) {
+	existing, _, err := n.client.Variables().Peek(leaderLockKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	lease := nomadLease{}
+	if existing != nil {
+		if raw, ok := existing.Items["lease"]; ok {
+			_ = json.Unmarshal([]byte(raw), &lease)
+		}
+	}
+	return &lease, nil
+}
+
+func (n *nomadLockElector) setPaused(ctx context.Context, paused bool) error {
+	lease, err := n.tryAcquireOrRenew(true)
+	if err != nil {
+		return err
+	}
+	lease.Paused = paused
+
+	encoded, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	existing, _, err := n.client.Variables().Peek(leaderLockKey, nil)
+	if err != nil {
+		return err
+	}
+	v := &nomadapi.Variable{Path: leaderLockKey, Items: nomadapi.VariableItems{"lease": string(encoded)}}
+	if existing == nil {
+		_, _, err = n.client.Variables().Create(v, nil)
+		return err
+	}
+	v.ModifyIndex = existing.ModifyIndex
+	_, _, err = n.client.Variables().CheckedUpdate(v, nil)
+	return err
+}
+
+func (n *nomadLockElector) paused() bool {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.isPaused
+}
+
+// ---- /v1/leader endpoint ----------------------------------------------------
+
+// leaderStatus is the JSON body served by /v1/leader.
+type leaderStatus struct {
+	Leader bool `json:"leader"`
+}
+
+// serveLeaderStatus runs an HTTP server exposing whether this aggregator
+// replica currently holds leadership, for operators and load balancers
+// that want to route around standbys.
+func serveLeaderStatus(addr string, isLeader *boolFlag) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/leader", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(leaderStatus{Leader: isLeader.get()})
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	if err := server.ListenAndServe(); err != nil {
+		log.Warning(fmt.Sprintf("Error serving /v1/leader: %v\n", err))
+	}
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// defaultMaxIneligibleFraction caps, absent any override, the fraction of a
+// failure domain's nodes that may be ineligible at once.
+const defaultMaxIneligibleFraction = 0.2
+
+// domainOverride lets an operator tune the safety policy for one specific
+// failure domain, e.g. a datacenter known to be smaller or more critical
+// than the rest of the fleet.
+type domainOverride struct {
+	MaxIneligibleFraction *float64 `json:"max_ineligible_fraction"`
+	MinHealthyCount       *int     `json:"min_healthy_count"`
+}
+
+// safetyConfig is the "safety" section of the aggregator config file.
+type safetyConfig struct {
+	// MaxIneligibleFraction bounds, per failure domain, the fraction of
+	// nodes that may be ineligible at the same time.
+	MaxIneligibleFraction float64 `json:"max_ineligible_fraction"`
+	// MinHealthyCount is the minimum number of eligible nodes a failure
+	// domain must retain, regardless of fraction.
+	MinHealthyCount int `json:"min_healthy_count"`
+	// MaxNodesPerMinute caps how many nodes, across the whole fleet, the
+	// aggregator may mark ineligible within a rolling minute.
+	MaxNodesPerMinute int `json:"max_nodes_per_minute"`
+	// Domains overrides the fleet-wide settings above for specific failure
+	// domains, keyed by "<datacenter>/<node_class>/<rack>".
+	Domains map[string]domainOverride `json:"domains"`
+}
+
+// domainStats tracks the eligibility counts the policy needs to reason
+// about a single failure domain, refreshed once per aggregation cycle.
+type domainStats struct {
+	total      int
+	ineligible int
+}
+
+// safetyPolicy prevents a correlated incident from draining an entire
+// failure domain at once. Before the aggregator flips a node ineligible, it
+// consults the policy; if flipping the node would violate the configured
+// fraction, floor, or fleet-wide rate limit, the action is deferred and
+// retried on a later cycle instead of applied immediately.
+type safetyPolicy struct {
+	configPath string
+
+	lock   sync.Mutex
+	config safetyConfig
+	stats  map[string]domainStats
+
+	// deferred tracks nodes whose ineligible transition was blocked by the
+	// policy, so the aggregation loop knows to keep retrying them even
+	// though their health check result hasn't changed cycle to cycle.
+	deferred map[string]bool
+
+	// rackByNodeID caches each node's "rack" meta value, refreshed once per
+	// cycle in refresh. api.Nodes().List() returns *api.NodeListStub, which
+	// carries no Meta, so the rack has to be fetched separately via
+	// Nodes().Info() per node; caching it here means allowIneligible (called
+	// later in the same cycle) doesn't have to fetch it again.
+	rackByNodeID map[string]string
+
+	// rateWindowStart and rateCount implement a simple fixed-window limiter for
+	// the fleet-wide "nodes per minute" cap.
+	rateWindowStart time.Time
+	rateCount       int
+}
+
+// newSafetyPolicy loads a safety policy from configPath. An empty path
+// yields a policy with the package defaults and no per-domain overrides.
+func newSafetyPolicy(configPath string) (*safetyPolicy, error) {
+	p := &safetyPolicy{
+		configPath:   configPath,
+		stats:        make(map[string]domainStats),
+		deferred:     make(map[string]bool),
+		rackByNodeID: make(map[string]string),
+	}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// reload re-reads the policy's config file from disk. It's safe to call
+// concurrently with allowIneligible/refresh and is wired up to SIGHUP so operators can
+// retune the policy without restarting the aggregator.
+func (p *safetyPolicy) reload() error {
+	cfg := safetyConfig{
+		MaxIneligibleFraction: defaultMaxIneligibleFraction,
+	}
+
+	if p.configPath != "" {
+		data, err := ioutil.ReadFile(p.configPath)
+		if err != nil {
+			return err
+		}
+		// The safety policy shares the aggregator's --config file, under a
+		// "safety" section, the same way output sinks live under "outputs".
+		wrapper := struct {
+			Safety safetyConfig `json:"safety"`
+		}{Safety: cfg}
+		if err := json.Unmarshal(data, &wrapper); err != nil {
+			return err
+		}
+		cfg = wrapper.Safety
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.config = cfg
+	return nil
+}
+
+// domainKey identifies a node's failure domain for the purposes of this
+// policy: its datacenter, node class, and (if set) rack metadata. The rack
+// comes from the cache refresh populates, since the *api.NodeListStub List()
+// returns carries no Meta of its own.
+func (p *safetyPolicy) domainKey(node *api.NodeListStub) string {
+	p.lock.Lock()
+	rack := p.rackByNodeID[node.ID]
+	p.lock.Unlock()
+	return fmt.Sprintf("%s/%s/%s", node.Datacenter, node.NodeClass, rack)
+}
+
+// refresh recomputes per-domain eligibility counts from the latest node
+// list. The aggregation loop calls this once per cycle before evaluating
+// any individual node, so every allowIneligible call in that cycle sees a consistent
+// snapshot of the fleet. nodeHandle is used to fetch each node's full
+// api.Node, the only way to read its "rack" meta value.
+func (p *safetyPolicy) refresh(nodeHandle *api.Nodes, nodes []*api.NodeListStub) {
+	rackByNodeID := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		full, _, err := nodeHandle.Info(node.ID, nil)
+		if err != nil {
+			log.Warning(fmt.Sprintf("Error fetching node info for %s, treating its rack as unset: %v\n", node.Address, err))
+			continue
+		}
+		rackByNodeID[node.ID] = full.Meta["rack"]
+	}
+
+	p.lock.Lock()
+	p.rackByNodeID = rackByNodeID
+	p.lock.Unlock()
+
+	stats := make(map[string]domainStats, len(p.stats))
+	for _, node := range nodes {
+		key := p.domainKey(node)
+		s := stats[key]
+		s.total++
+		if node.SchedulingEligibility == api.NodeSchedulingIneligible {
+			s.ineligible++
+		}
+		stats[key] = s
+	}
+
+	p.lock.Lock()
+	p.stats = stats
+	p.lock.Unlock()
+}
+
+// domainLimits resolves the effective fraction/floor for a failure domain,
+// applying any configured override.
+func (p *safetyPolicy) domainLimits(key string) (maxFraction float64, minHealthy int) {
+	maxFraction = p.config.MaxIneligibleFraction
+	minHealthy = p.config.MinHealthyCount
+
+	if override, ok := p.config.Domains[key]; ok {
+		if override.MaxIneligibleFraction != nil {
+			maxFraction = *override.MaxIneligibleFraction
+		}
+		if override.MinHealthyCount != nil {
+			minHealthy = *override.MinHealthyCount
+		}
+	}
+	return maxFraction, minHealthy
+}
+
+// allowIneligible reports whether nodeID may be marked ineligible right now
+// without violating the per-domain fraction, the per-domain healthy floor,
+// or the fleet-wide rate limit. If it returns false, the caller should keep
+// the node eligible and retry on the next cycle; allowIneligible records the
+// node as deferred so the aggregation loop knows to do exactly that.
+func (p *safetyPolicy) allowIneligible(node *api.NodeListStub) bool {
+	key := p.domainKey(node)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	maxFraction, minHealthy := p.domainLimits(key)
+	s := p.stats[key]
+
+	// The node being evaluated is currently eligible (that's why we're
+	// considering marking it ineligible), so model the fraction and floor
+	// as if this one additional node were already ineligible.
+	projectedIneligible := s.ineligible + 1
+	projectedHealthy := s.total - projectedIneligible
+
+	if s.total > 0 && float64(projectedIneligible)/float64(s.total) > maxFraction {
+		log.Warning(fmt.Sprintf(
+			"Safety policy deferring ineligible transition for node %s: failure domain %q would exceed max ineligible fraction %.2f\n",
+			node.Address, key, maxFraction))
+		p.deferred[node.ID] = true
+		return false
+	}
+
+	if minHealthy > 0 && projectedHealthy < minHealthy {
+		log.Warning(fmt.Sprintf(
+			"Safety policy deferring ineligible transition for node %s: failure domain %q would drop below min healthy count %d\n",
+			node.Address, key, minHealthy))
+		p.deferred[node.ID] = true
+		return false
+	}
+
+	if !p.allowRateLimit() {
+		log.Warning(fmt.Sprintf(
+			"Safety policy deferring ineligible transition for node %s: exceeded %d nodes/minute global rate limit\n",
+			node.Address, p.config.MaxNodesPerMinute))
+		p.deferred[node.ID] = true
+		return false
+	}
+
+	delete(p.deferred, node.ID)
+	return true
+}
+
+// allowRateLimit enforces the fleet-wide "nodes per minute" cap using a
+// fixed one-minute window. Callers must hold p.lock.
+func (p *safetyPolicy) allowRateLimit() bool {
+	if p.config.MaxNodesPerMinute <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	if now.Sub(p.rateWindowStart) >= time.Minute {
+		p.rateWindowStart = now
+		p.rateCount = 0
+	}
+
+	if p.rateCount >= p.config.MaxNodesPerMinute {
+		return false
+	}
+
+	p.rateCount++
+	return true
+}
+
+// isDeferred reports whether nodeID's ineligible transition was previously
+// blocked by the policy and should be retried even if its health check
+// result hasn't changed since the last cycle.
+func (p *safetyPolicy) isDeferred(nodeID string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.deferred[nodeID]
+}
+
+// clearDeferred forgets a node's deferred ineligible transition, e.g.
+// because it recovered before the policy ever let it through.
+func (p *safetyPolicy) clearDeferred(nodeID string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.deferred, nodeID)
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregator
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDomainKey(t *testing.T) {
+	node := &api.NodeListStub{ID: "node-1", Datacenter: "dc1", NodeClass: "compute"}
+	p := &safetyPolicy{rackByNodeID: map[string]string{"node-1": "r1"}}
+	assert.Equal(t, "dc1/compute/r1", p.domainKey(node))
+
+	noRack := &api.NodeListStub{ID: "node-2", Datacenter: "dc1", NodeClass: "compute"}
+	assert.Equal(t, "dc1/compute/", p.domainKey(noRack))
+}
+
+func TestDomainLimits(t *testing.T) {
+	p := &safetyPolicy{
+		config: safetyConfig{
+			MaxIneligibleFraction: 0.2,
+			MinHealthyCount:       3,
+			Domains: map[string]domainOverride{
+				"dc1/compute/": {MaxIneligibleFraction: floatPtr(0.5)},
+			},
+		},
+	}
+
+	maxFraction, minHealthy := p.domainLimits("dc1/compute/")
+	assert.Equal(t, 0.5, maxFraction)
+	assert.Equal(t, 3, minHealthy)
+
+	maxFraction, minHealthy = p.domainLimits("dc2/compute/")
+	assert.Equal(t, 0.2, maxFraction)
+	assert.Equal(t, 3, minHealthy)
+}
+
+func floatPtr(f float64) *float64 { return &f }
+
+func TestAllowIneligibleFraction(t *testing.T) {
+	p := &safetyPolicy{
+		config:   safetyConfig{MaxIneligibleFraction: 0.2},
+		stats:    map[string]domainStats{"dc1/compute/": {total: 10, ineligible: 1}},
+		deferred: make(map[string]bool),
+	}
+
+	node := &api.NodeListStub{ID: "node-1", Address: "1.1.1.1", Datacenter: "dc1", NodeClass: "compute"}
+
+	// Marking node-1 ineligible would push the domain to 2/10 = 0.2, which is
+	// still within the 0.2 fraction limit.
+	assert.True(t, p.allowIneligible(node))
+	assert.False(t, p.isDeferred(node.ID))
+
+	// A second node would push the domain to 3/10 = 0.3, over the limit.
+	p.stats["dc1/compute/"] = domainStats{total: 10, ineligible: 2}
+	node2 := &api.NodeListStub{ID: "node-2", Address: "2.2.2.2", Datacenter: "dc1", NodeClass: "compute"}
+	assert.False(t, p.allowIneligible(node2))
+	assert.True(t, p.isDeferred(node2.ID))
+
+	p.clearDeferred(node2.ID)
+	assert.False(t, p.isDeferred(node2.ID))
+}
+
+func TestAllowIneligibleMinHealthyFloor(t *testing.T) {
+	p := &safetyPolicy{
+		config:   safetyConfig{MaxIneligibleFraction: 1, MinHealthyCount: 5},
+		stats:    map[string]domainStats{"dc1/compute/": {total: 6, ineligible: 0}},
+		deferred: make(map[string]bool),
+	}
+
+	node := &api.NodeListStub{ID: "node-1", Address: "1.1.1.1", Datacenter: "dc1", NodeClass: "compute"}
+
+	// Marking node-1 ineligible would leave 5 healthy, exactly at the floor.
+	assert.True(t, p.allowIneligible(node))
+
+	p.stats["dc1/compute/"] = domainStats{total: 6, ineligible: 1}
+	node2 := &api.NodeListStub{ID: "node-2", Address: "2.2.2.2", Datacenter: "dc1", NodeClass: "compute"}
+	// Marking node-2 ineligible too would drop healthy to 4, below the floor.
+	assert.False(t, p.allowIneligible(node2))
+	assert.True(t, p.isDeferred(node2.ID))
+}
+
+func TestAllowIneligibleRateLimit(t *testing.T) {
+	p := &safetyPolicy{
+		config:   safetyConfig{MaxIneligibleFraction: 1, MaxNodesPerMinute: 1},
+		stats:    map[string]domainStats{"dc1/compute/": {total: 10, ineligible: 0}},
+		deferred: make(map[string]bool),
+	}
+
+	node := &api.NodeListStub{ID: "node-1", Address: "1.1.1.1", Datacenter: "dc1", NodeClass: "compute"}
+	node2 := &api.NodeListStub{ID: "node-2", Address: "2.2.2.2", Datacenter: "dc1", NodeClass: "compute"}
+
+	assert.True(t, p.allowIneligible(node))
+	assert.False(t, p.allowIneligible(node2))
+	assert.True(t, p.isDeferred(node2.ID))
+}
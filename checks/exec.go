@@ -0,0 +1,67 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package checks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+
+	types "github.com/nomad-node-problem-detector/types"
+)
+
+func init() {
+	Register("exec", func() Runner { return &execRunner{} })
+}
+
+// execRunner runs config.HealthCheck as a command, re-invoked on every
+// evaluation, with config.Params piped to its stdin as JSON so the command
+// doesn't need its own config file. It must print a JSON-encoded
+// types.HealthCheck to stdout.
+type execRunner struct {
+	command string
+	params  json.RawMessage
+}
+
+func (r *execRunner) Init(config types.Config) error {
+	r.command = config.HealthCheck
+	r.params = config.Params
+	return nil
+}
+
+func (r *execRunner) Check(ctx context.Context) (types.HealthCheck, error) {
+	cmd := exec.CommandContext(ctx, r.command)
+	if len(r.params) > 0 {
+		cmd.Stdin = bytes.NewReader(r.params)
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		return types.HealthCheck{}, err
+	}
+
+	var check types.HealthCheck
+	if err := json.Unmarshal(out, &check); err != nil {
+		return types.HealthCheck{}, fmt.Errorf("exec check %s: %v", r.command, err)
+	}
+	return check, nil
+}
+
+func (r *execRunner) Close() {}
@@ -0,0 +1,129 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package checks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sync"
+
+	hplugin "github.com/hashicorp/go-plugin"
+	types "github.com/nomad-node-problem-detector/types"
+)
+
+func init() {
+	Register("grpc", func() Runner { return &grpcRunner{} })
+}
+
+// grpcHandshake is the handshake go-plugin exchanges with a "grpc" check
+// plugin over stdout before trusting its gRPC endpoint. The magic cookie is
+// just a sanity check that the configured binary is actually an NNPD check
+// plugin, not a guard against anything adversarial.
+var grpcHandshake = hplugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "NNPD_CHECK_PLUGIN",
+	MagicCookieValue: "nnpd",
+}
+
+// grpcConfig is config.Params for a "grpc" check.
+type grpcConfig struct {
+	Args []string `json:"args"`
+}
+
+// grpcRunner launches config.HealthCheck as a long-lived go-plugin
+// subprocess speaking the checks.HealthCheck gRPC service (see
+// grpc_service.go), instead of being re-forked every evaluation like
+// "script" and "exec" are. It only implements Streamer: a single plugin
+// process pushes continuous updates, which suits checks like temperature
+// sensors or GPU ECC counters that don't map naturally onto being polled.
+type grpcRunner struct {
+	command string
+	args    []string
+	params  json.RawMessage
+
+	// lock guards client, which Stream writes on every (re)connect and
+	// Close reads from a separate goroutine when the scheduler shuts
+	// down.
+	lock   sync.Mutex
+	client *hplugin.Client
+}
+
+func (r *grpcRunner) Init(config types.Config) error {
+	r.command = config.HealthCheck
+	r.params = config.Params
+
+	var cfg grpcConfig
+	if len(config.Params) > 0 {
+		if err := json.Unmarshal(config.Params, &cfg); err != nil {
+			return err
+		}
+	}
+	r.args = cfg.Args
+	return nil
+}
+
+// Check is unsupported: "grpc" checks are dispatched through Stream instead
+// of being polled, since re-forking the plugin on every evaluation would
+// defeat the point of a long-lived process.
+func (r *grpcRunner) Check(ctx context.Context) (types.HealthCheck, error) {
+	return types.HealthCheck{}, fmt.Errorf("grpc check %s: does not support polling, use Stream", r.command)
+}
+
+// Stream launches the plugin subprocess, dispenses the healthcheck gRPC
+// client go-plugin negotiates, and relays every result it sends to updates
+// until ctx is done or the plugin process exits.
+func (r *grpcRunner) Stream(ctx context.Context, updates chan<- types.HealthCheck) error {
+	client := hplugin.NewClient(&hplugin.ClientConfig{
+		HandshakeConfig:  grpcHandshake,
+		Plugins:          hplugin.PluginSet{"healthcheck": &healthCheckPlugin{params: r.params}},
+		Cmd:              exec.Command(r.command, r.args...),
+		AllowedProtocols: []hplugin.Protocol{hplugin.ProtocolGRPC},
+	})
+	r.lock.Lock()
+	r.client = client
+	r.lock.Unlock()
+
+	rpcClient, err := client.Client()
+	if err != nil {
+		return fmt.Errorf("grpc check %s: %v", r.command, err)
+	}
+
+	raw, err := rpcClient.Dispense("healthcheck")
+	if err != nil {
+		return fmt.Errorf("grpc check %s: %v", r.command, err)
+	}
+
+	hc, ok := raw.(healthCheckClient)
+	if !ok {
+		return fmt.Errorf("grpc check %s: plugin did not implement the healthcheck service", r.command)
+	}
+
+	return hc.Check(ctx, updates)
+}
+
+func (r *grpcRunner) Close() {
+	r.lock.Lock()
+	client := r.client
+	r.lock.Unlock()
+
+	if client != nil {
+		client.Kill()
+	}
+}
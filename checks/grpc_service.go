@@ -0,0 +1,151 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package checks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	hplugin "github.com/hashicorp/go-plugin"
+	types "github.com/nomad-node-problem-detector/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// The checks.HealthCheck gRPC service a "grpc" check plugin implements has
+// a single server-streaming method:
+//
+//	service HealthCheck {
+//	  rpc Check(CheckRequest) returns (stream HealthCheckResult);
+//	}
+//
+// This file hand-writes the client/server plumbing protoc-gen-go-grpc would
+// otherwise generate from that definition, since plugin binaries built
+// against this repo have no protoc step. CheckRequest and HealthCheckResult
+// (types.HealthCheck) are exchanged as JSON via the "json" codec below
+// rather than the protobuf wire format, for the same reason.
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// jsonCodec lets the HealthCheck service exchange messages as JSON instead
+// of protobuf, since CheckRequest and types.HealthCheck don't implement
+// proto.Message.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return "json" }
+
+const healthCheckServiceName = "checks.HealthCheck"
+
+// checkRequest is the request message for HealthCheck.Check.
+type checkRequest struct {
+	Params json.RawMessage `json:"params"`
+}
+
+// healthCheckStreamDesc describes the HealthCheck service's single
+// server-streaming method, shared by the server's RegisterService and the
+// client's NewStream call.
+var healthCheckStreamDesc = grpc.StreamDesc{
+	StreamName:    "Check",
+	Handler:       checkStreamHandler,
+	ServerStreams: true,
+}
+
+// healthCheckServiceDesc describes the HealthCheck service for registering a
+// healthCheckServer with a grpc.Server. It and healthCheckServer are
+// unexported, so only code inside this package can register a server with
+// them; the detector itself never does, and only ever dials the service as a
+// client.
+var healthCheckServiceDesc = grpc.ServiceDesc{
+	ServiceName: healthCheckServiceName,
+	HandlerType: (*healthCheckServer)(nil),
+	Streams:     []grpc.StreamDesc{healthCheckStreamDesc},
+}
+
+// healthCheckServer is the server-side handler healthCheckServiceDesc
+// dispatches the Check stream to.
+type healthCheckServer interface {
+	Check(req *checkRequest, stream grpc.ServerStream) error
+}
+
+func checkStreamHandler(srv interface{}, stream grpc.ServerStream) error {
+	var req checkRequest
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	return srv.(healthCheckServer).Check(&req, stream)
+}
+
+// healthCheckClient is what grpcRunner.Stream dispenses: a client-side stub
+// over the gRPC connection go-plugin negotiated to the plugin process.
+type healthCheckClient interface {
+	// Check opens the Check stream with params and relays every
+	// HealthCheckResult it receives to updates until the stream ends.
+	Check(ctx context.Context, updates chan<- types.HealthCheck) error
+}
+
+type healthCheckClientImpl struct {
+	conn   *grpc.ClientConn
+	params json.RawMessage
+}
+
+func (c *healthCheckClientImpl) Check(ctx context.Context, updates chan<- types.HealthCheck) error {
+	stream, err := c.conn.NewStream(ctx, &healthCheckStreamDesc, "/"+healthCheckServiceName+"/Check", grpc.CallContentSubtype(jsonCodec{}.Name()))
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(&checkRequest{Params: c.params}); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+
+	for {
+		var result types.HealthCheck
+		if err := stream.RecvMsg(&result); err != nil {
+			return err
+		}
+		select {
+		case updates <- result:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// healthCheckPlugin is the go-plugin GRPCPlugin registered under the
+// "healthcheck" name in grpcRunner.Stream's PluginSet. The detector only
+// ever acts as the gRPC client of a check plugin process, so GRPCServer is
+// unused and only present to satisfy the interface.
+type healthCheckPlugin struct {
+	hplugin.Plugin
+	params json.RawMessage
+}
+
+func (p *healthCheckPlugin) GRPCServer(broker *hplugin.GRPCBroker, s *grpc.Server) error {
+	return fmt.Errorf("healthcheck plugin: GRPCServer is not implemented by the detector")
+}
+
+func (p *healthCheckPlugin) GRPCClient(ctx context.Context, broker *hplugin.GRPCBroker, conn *grpc.ClientConn) (interface{}, error) {
+	return &healthCheckClientImpl{conn: conn, params: p.params}, nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package checks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	types "github.com/nomad-node-problem-detector/types"
+)
+
+func init() {
+	Register("http", func() Runner { return &httpRunner{} })
+}
+
+// httpConfig is config.Params for an "http" check.
+type httpConfig struct {
+	URL string `json:"url"`
+}
+
+// httpRunner polls a URL for a JSON-encoded types.HealthCheck body. The URL
+// comes from Params.url, falling back to config.HealthCheck so the simple
+// case doesn't need a Params block at all.
+type httpRunner struct {
+	url    string
+	client *http.Client
+}
+
+func (r *httpRunner) Init(config types.Config) error {
+	var cfg httpConfig
+	if len(config.Params) > 0 {
+		if err := json.Unmarshal(config.Params, &cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.URL == "" {
+		cfg.URL = config.HealthCheck
+	}
+
+	r.url = cfg.URL
+	r.client = &http.Client{Timeout: 10 * time.Second}
+	return nil
+}
+
+func (r *httpRunner) Check(ctx context.Context) (types.HealthCheck, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return types.HealthCheck{}, err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return types.HealthCheck{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return types.HealthCheck{}, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, r.url)
+	}
+
+	var check types.HealthCheck
+	if err := json.NewDecoder(resp.Body).Decode(&check); err != nil {
+		return types.HealthCheck{}, err
+	}
+	return check, nil
+}
+
+func (r *httpRunner) Close() {}
@@ -0,0 +1,90 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package checks implements a pluggable protocol for node health checks,
+// modeled after the outputs package's sink registry. A types.Config's Kind
+// selects which Runner evaluates it: a shell script, a re-invoked exec
+// command, an HTTP endpoint, or a long-lived gRPC plugin.
+package checks
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	types "github.com/nomad-node-problem-detector/types"
+)
+
+// Runner evaluates one configured health check. Implementations are
+// registered by Kind via Register and instantiated from a types.Config by
+// New.
+type Runner interface {
+	// Init configures the runner from its types.Config entry.
+	Init(config types.Config) error
+	// Check runs the health check once and returns its current result.
+	// Kinds that only stream (currently "grpc") return an error instead;
+	// the detector dispatches those through Streamer.Stream.
+	Check(ctx context.Context) (types.HealthCheck, error)
+	// Close releases any resources (subprocess, plugin client, HTTP
+	// client) the runner holds.
+	Close()
+}
+
+// Streamer is implemented by Runners that push continuous results instead
+// of being polled once per detection cycle, currently only the "grpc" kind.
+type Streamer interface {
+	// Stream starts the runner's plugin and relays every result it sends
+	// to updates until ctx is done or the plugin process exits.
+	Stream(ctx context.Context, updates chan<- types.HealthCheck) error
+}
+
+// Factory constructs a new, unconfigured Runner instance.
+type Factory func() Runner
+
+var (
+	registryLock sync.Mutex
+	registry     = make(map[string]Factory)
+)
+
+// Register adds a runner factory under kind. It panics if kind is already
+// registered, mirroring outputs.Register.
+func Register(kind string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, exists := registry[kind]; exists {
+		panic(fmt.Sprintf("checks: Register called twice for kind %q", kind))
+	}
+	registry[kind] = factory
+}
+
+// New instantiates a registered runner by kind. An empty kind defaults to
+// "script", preserving the historical shell-script-only behavior.
+func New(kind string) (Runner, error) {
+	if kind == "" {
+		kind = "script"
+	}
+
+	registryLock.Lock()
+	factory, ok := registry[kind]
+	registryLock.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("checks: no runner registered for kind %q", kind)
+	}
+	return factory(), nil
+}
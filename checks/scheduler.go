@@ -0,0 +1,211 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package checks
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	types "github.com/nomad-node-problem-detector/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultCheckTimeout bounds a single Check evaluation when a config entry
+// doesn't set its own Timeout.
+const defaultCheckTimeout = 5 * time.Second
+
+// streamReconnectInterval is how long Scheduler waits before relaunching a
+// Streamer whose Stream call returned, e.g. because the plugin process
+// crashed or the connection dropped.
+const streamReconnectInterval = 5 * time.Second
+
+// scheduleEntry is one configured check's Runner plus its own polling
+// cadence and most recently cached result.
+type scheduleEntry struct {
+	config   types.Config
+	runner   Runner
+	interval time.Duration
+	timeout  time.Duration
+
+	lock   sync.RWMutex
+	cached types.HealthCheck
+}
+
+// Scheduler runs every configured check at its own Interval (or a default
+// cycle time) instead of the detector's overall detection-cycle-time,
+// caching each check's most recent result so an expensive check can declare
+// a longer re-evaluation interval without the detector forcing it to run
+// every cycle. Streamer checks are exempt from polling entirely: Scheduler
+// launches each once and relays whatever it pushes.
+type Scheduler struct {
+	entries  []*scheduleEntry
+	onResult func(types.HealthCheck)
+}
+
+// NewScheduler instantiates and initializes a Runner for every entry in
+// configs. defaultInterval is used for any entry that doesn't set its own
+// Interval. onResult is called with every fresh result, polled or streamed.
+func NewScheduler(configs []types.Config, defaultInterval time.Duration, onResult func(types.HealthCheck)) (*Scheduler, error) {
+	s := &Scheduler{onResult: onResult}
+
+	for _, config := range configs {
+		runner, err := New(config.Kind)
+		if err != nil {
+			return nil, fmt.Errorf("checks: error loading check %q: %v", config.Type, err)
+		}
+		if err := runner.Init(config); err != nil {
+			return nil, fmt.Errorf("checks: error initializing check %q: %v", config.Type, err)
+		}
+
+		interval := defaultInterval
+		if config.Interval != "" {
+			interval, err = time.ParseDuration(config.Interval)
+			if err != nil {
+				return nil, fmt.Errorf("checks: invalid interval for check %q: %v", config.Type, err)
+			}
+		}
+
+		timeout := defaultCheckTimeout
+		if config.Timeout != "" {
+			timeout, err = time.ParseDuration(config.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("checks: invalid timeout for check %q: %v", config.Type, err)
+			}
+		}
+
+		s.entries = append(s.entries, &scheduleEntry{
+			config:   config,
+			runner:   runner,
+			interval: interval,
+			timeout:  timeout,
+		})
+	}
+
+	return s, nil
+}
+
+// Start launches every configured check: polled checks on their own
+// ticker, Streamer checks in a single long-lived goroutine each. It returns
+// immediately; checks keep running until ctx is done.
+func (s *Scheduler) Start(ctx context.Context) {
+	for _, entry := range s.entries {
+		if streamer, ok := entry.runner.(Streamer); ok {
+			go s.runStream(ctx, entry, streamer)
+		} else {
+			go s.runPoll(ctx, entry)
+		}
+	}
+}
+
+// runPoll evaluates entry.runner once immediately and then every
+// entry.interval until ctx is done.
+func (s *Scheduler) runPoll(ctx context.Context, entry *scheduleEntry) {
+	ticker := time.NewTicker(entry.interval)
+	defer ticker.Stop()
+
+	s.evaluate(ctx, entry)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.evaluate(ctx, entry)
+		}
+	}
+}
+
+// evaluate runs entry.runner.Check bounded by entry.timeout, caching and
+// reporting the result if it succeeds.
+func (s *Scheduler) evaluate(ctx context.Context, entry *scheduleEntry) {
+	checkCtx, cancel := context.WithTimeout(ctx, entry.timeout)
+	defer cancel()
+
+	result, err := entry.runner.Check(checkCtx)
+	if err != nil {
+		log.Warning(fmt.Sprintf("Error in running health check %s: %v\n", entry.config.HealthCheck, err))
+		return
+	}
+	result.Type = entry.config.Type
+
+	entry.lock.Lock()
+	entry.cached = result
+	entry.lock.Unlock()
+
+	s.onResult(result)
+}
+
+// runStream launches streamer once and relays every update it sends until
+// ctx is done, relaunching it after streamReconnectInterval each time it
+// returns.
+func (s *Scheduler) runStream(ctx context.Context, entry *scheduleEntry, streamer Streamer) {
+	for ctx.Err() == nil {
+		updates := make(chan types.HealthCheck, 16)
+		done := make(chan error, 1)
+		go func() { done <- streamer.Stream(ctx, updates) }()
+
+	relay:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case result := <-updates:
+				result.Type = entry.config.Type
+
+				entry.lock.Lock()
+				entry.cached = result
+				entry.lock.Unlock()
+
+				s.onResult(result)
+			case err := <-done:
+				if err != nil {
+					log.Warning(fmt.Sprintf("Stream for health check %s ended, reconnecting in %s: %v\n", entry.config.HealthCheck, streamReconnectInterval, err))
+				}
+				break relay
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(streamReconnectInterval):
+		}
+	}
+}
+
+// Snapshot returns the most recently cached result of every check that has
+// produced at least one result so far.
+func (s *Scheduler) Snapshot() []types.HealthCheck {
+	checks := make([]types.HealthCheck, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entry.lock.RLock()
+		if entry.cached.Type != "" {
+			checks = append(checks, entry.cached)
+		}
+		entry.lock.RUnlock()
+	}
+	return checks
+}
+
+// Close releases every check's Runner.
+func (s *Scheduler) Close() {
+	for _, entry := range s.entries {
+		entry.runner.Close()
+	}
+}
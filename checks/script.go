@@ -0,0 +1,58 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package checks
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	types "github.com/nomad-node-problem-detector/types"
+)
+
+func init() {
+	Register("script", func() Runner { return &scriptRunner{} })
+}
+
+// scriptRunner runs a shell script health check: config.HealthCheck names an
+// executable whose trimmed stdout is the check's result. This is the
+// original, and still default, check kind.
+type scriptRunner struct {
+	path string
+}
+
+func (r *scriptRunner) Init(config types.Config) error {
+	r.path = config.HealthCheck
+	return nil
+}
+
+func (r *scriptRunner) Check(ctx context.Context) (types.HealthCheck, error) {
+	out, err := exec.CommandContext(ctx, r.path).Output()
+	if err != nil {
+		return types.HealthCheck{}, err
+	}
+
+	result := strings.TrimSpace(string(out))
+	return types.HealthCheck{
+		Result:  result,
+		Message: fmt.Sprintf("%s reported %s", r.path, result),
+	}, nil
+}
+
+func (r *scriptRunner) Close() {}
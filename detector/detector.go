@@ -0,0 +1,362 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package detector
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/nomad-node-problem-detector/checks"
+	types "github.com/nomad-node-problem-detector/types"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/urfave/cli/v2"
+)
+
+// streamResponseBufferSize sizes the bufio.Writer nodeHealthStreamHandler
+// wraps the response in. Some grpc-websocket-proxy deployments in front of
+// NNPD cap message framing at 64 KiB by default, so we buffer writes
+// ourselves at a size comfortably above that rather than relying on
+// net/http's unbuffered ResponseWriter.
+const streamResponseBufferSize = 1 << 20 // 1 MiB
+
+// streamHeartbeatInterval controls how often an idle stream connection sends a
+// heartbeat frame so intermediate proxies don't time it out.
+const streamHeartbeatInterval = 30 * time.Second
+
+var DetectorCommand = &cli.Command{
+	Name:  "detector",
+	Usage: "Run npd in detector mode",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config",
+			Aliases: []string{"c"},
+			Value:   "/etc/nnpd/config.json",
+			Usage:   "Path to health check config file",
+		},
+		&cli.StringFlag{
+			Name:    "detector-port",
+			Aliases: []string{"p"},
+			Value:   ":8083",
+			Usage:   "Detector HTTP server port",
+		},
+		&cli.StringFlag{
+			Name:    "detection-cycle-time",
+			Aliases: []string{"t"},
+			Value:   "15s",
+			Usage:   "Time (in seconds) to wait between each detection cycle",
+		},
+		&cli.Float64Flag{
+			Name:  "cpu-limit",
+			Value: 80.0,
+			Usage: "CPU usage percentage above which the node is under pressure",
+		},
+		&cli.Float64Flag{
+			Name:  "memory-limit",
+			Value: 80.0,
+			Usage: "Memory usage percentage above which the node is under pressure",
+		},
+		&cli.Float64Flag{
+			Name:  "disk-limit",
+			Value: 80.0,
+			Usage: "Disk usage percentage above which the node is under pressure",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		return detect(c)
+	},
+}
+
+// m holds the latest result of every health check, keyed by check type.
+var m = make(map[string]types.HealthCheck)
+var mLock sync.RWMutex
+
+// subscribers receive a copy of a health check every time its result changes,
+// so the /v1/nodehealth/stream handler can push updates without polling m.
+var subscribers = make(map[chan types.HealthCheck]bool)
+var subscribersLock sync.Mutex
+
+// subscribe registers a new stream subscriber and returns a channel of
+// health check updates. Call unsubscribe to stop receiving updates.
+func subscribe() chan types.HealthCheck {
+	ch := make(chan types.HealthCheck, 16)
+	subscribersLock.Lock()
+	subscribers[ch] = true
+	subscribersLock.Unlock()
+	return ch
+}
+
+// unsubscribe removes a stream subscriber and closes its channel.
+func unsubscribe(ch chan types.HealthCheck) {
+	subscribersLock.Lock()
+	delete(subscribers, ch)
+	subscribersLock.Unlock()
+	close(ch)
+}
+
+// publish notifies all stream subscribers of a changed health check, dropping
+// the update for any subscriber whose channel is currently full rather than
+// blocking the detection loop.
+func publish(check types.HealthCheck) {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+	for ch := range subscribers {
+		select {
+		case ch <- check:
+		default:
+			log.Warning(fmt.Sprintf("Stream subscriber is falling behind, dropping %s update\n", check.Type))
+		}
+	}
+}
+
+// detect runs the built-in resource checks on a fixed cycle, hands the
+// configured checks to a checks.Scheduler so each can keep its own
+// interval, and serves the combined results over HTTP for the aggregator
+// to poll.
+func detect(cliCtx *cli.Context) error {
+	configPath := cliCtx.String("config")
+	detectorPort := cliCtx.String("detector-port")
+	cpuLimit := cliCtx.Float64("cpu-limit")
+	memoryLimit := cliCtx.Float64("memory-limit")
+	diskLimit := cliCtx.Float64("disk-limit")
+
+	detectionCycleTime, err := time.ParseDuration(cliCtx.String("detection-cycle-time"))
+	if err != nil {
+		return err
+	}
+
+	config := []types.Config{}
+	if err := readConfig(configPath, &config); err != nil {
+		return err
+	}
+
+	scheduler, err := checks.NewScheduler(config, detectionCycleTime, setCheck)
+	if err != nil {
+		return err
+	}
+	defer scheduler.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	scheduler.Start(ctx)
+
+	go func() {
+		for {
+			getCPUStats(cpuLimit)
+			getMemoryStats(memoryLimit)
+			getDiskStats(diskLimit)
+			time.Sleep(detectionCycleTime)
+		}
+	}()
+
+	http.HandleFunc("/v1/health/", authMiddleware(healthHandler))
+	http.HandleFunc("/v1/nodehealth/", authMiddleware(nodeHealthHandler))
+	http.HandleFunc("/v1/nodehealth/stream", authMiddleware(nodeHealthStreamHandler))
+	server := &http.Server{
+		Addr: detectorPort,
+	}
+	return server.ListenAndServe()
+}
+
+// readConfig reads and unmarshals a JSON health check config file into config.
+func readConfig(path string, config interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, config)
+}
+
+// getCPUStats records whether the node is under CPU pressure.
+func getCPUStats(cpuLimit float64) {
+	percents, err := cpu.Percent(time.Second, false)
+	if err != nil || len(percents) == 0 {
+		log.Warning(fmt.Sprintf("Error in getting CPU stats: %v\n", err))
+		return
+	}
+
+	result := "false"
+	if percents[0] > cpuLimit {
+		result = "true"
+	}
+
+	setCheck(types.HealthCheck{
+		Type:    "CPUUnderPressure",
+		Result:  result,
+		Message: fmt.Sprintf("CPU usage is at %.2f%%, limit %.2f%%", percents[0], cpuLimit),
+	})
+}
+
+// getMemoryStats records whether the node is under memory pressure.
+func getMemoryStats(memoryLimit float64) {
+	v, err := mem.VirtualMemory()
+	if err != nil {
+		log.Warning(fmt.Sprintf("Error in getting memory stats: %v\n", err))
+		return
+	}
+
+	result := "false"
+	if v.UsedPercent > memoryLimit {
+		result = "true"
+	}
+
+	setCheck(types.HealthCheck{
+		Type:    "MemoryUnderPressure",
+		Result:  result,
+		Message: fmt.Sprintf("%.2f%% memory available out of %d bytes total", 100-v.UsedPercent, v.Total),
+	})
+}
+
+// getDiskStats records whether the node's root disk usage is too high.
+func getDiskStats(diskLimit float64) {
+	u, err := disk.Usage("/")
+	if err != nil {
+		log.Warning(fmt.Sprintf("Error in getting disk stats: %v\n", err))
+		return
+	}
+
+	result := "false"
+	if u.UsedPercent > diskLimit {
+		result = "true"
+	}
+
+	setCheck(types.HealthCheck{
+		Type:    "DiskUsageHigh",
+		Result:  result,
+		Message: fmt.Sprintf("disk usage is at %.2f%%, limit %.2f%%", u.UsedPercent, diskLimit),
+	})
+}
+
+// setCheck records the latest result for a health check type and notifies
+// stream subscribers if the result changed.
+func setCheck(check types.HealthCheck) {
+	mLock.Lock()
+	prev, ok := m[check.Type]
+	m[check.Type] = check
+	mLock.Unlock()
+
+	if !ok || !reflect.DeepEqual(prev, check) {
+		publish(check)
+	}
+}
+
+// snapshot returns the current value of every health check.
+func snapshot() []types.HealthCheck {
+	mLock.RLock()
+	defer mLock.RUnlock()
+
+	checks := make([]types.HealthCheck, 0, len(m))
+	for _, check := range m {
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// authMiddleware validates the DETECTOR_HTTP_TOKEN basic auth header, if one is configured.
+func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authToken := os.Getenv("DETECTOR_HTTP_TOKEN")
+		if authToken == "" {
+			next(w, r)
+			return
+		}
+
+		expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(authToken))
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// healthHandler reports whether the detector process itself is up.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// nodeHealthHandler returns the latest result of every health check as JSON.
+func nodeHealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(snapshot()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// nodeHealthStreamHandler pushes a newline-delimited JSON types.HealthCheck
+// event every time a check's result changes, instead of requiring the
+// aggregator to poll /v1/nodehealth/. A heartbeat frame is sent on idle
+// connections so intermediaries (load balancers, proxies) don't kill them,
+// and the response is explicitly buffered at streamResponseBufferSize and
+// flushed after every write so events aren't held back indefinitely but
+// also aren't written in pieces smaller than that buffer can avoid.
+func nodeHealthStreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	ch := subscribe()
+	defer unsubscribe(ch)
+
+	buf := bufio.NewWriterSize(w, streamResponseBufferSize)
+	encoder := json.NewEncoder(buf)
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case check := <-ch:
+			if err := encoder.Encode(check); err != nil {
+				return
+			}
+			if err := buf.Flush(); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(buf, "\n"); err != nil {
+				return
+			}
+			if err := buf.Flush(); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package outputs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	types "github.com/nomad-node-problem-detector/types"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+func init() {
+	Register("file", func() Sink { return &fileSink{} })
+}
+
+// fileConfig configures the "file" sink.
+type fileConfig struct {
+	// Path is the file health events are appended to.
+	Path string `json:"path"`
+	// MaxSizeMB is the size a log file can grow to before it's rotated.
+	MaxSizeMB int `json:"max_size_mb"`
+	// MaxBackups is the number of rotated files to retain.
+	MaxBackups int `json:"max_backups"`
+}
+
+// fileEvent is one newline-delimited JSON record written to the sink file.
+type fileEvent struct {
+	NodeID    string              `json:"node_id"`
+	Timestamp time.Time           `json:"timestamp"`
+	Checks    []types.HealthCheck `json:"checks"`
+}
+
+// fileSink appends health events as newline-delimited JSON to a rotating
+// local file, for operators who want a durable local record without
+// standing up an external system.
+type fileSink struct {
+	lock   sync.Mutex
+	writer *lumberjack.Logger
+}
+
+func (f *fileSink) Name() string {
+	return "file"
+}
+
+func (f *fileSink) Init(rawCfg json.RawMessage) error {
+	cfg := fileConfig{MaxSizeMB: 100, MaxBackups: 5}
+	if err := json.Unmarshal(rawCfg, &cfg); err != nil {
+		return err
+	}
+	if cfg.Path == "" {
+		return fmt.Errorf("file sink requires \"path\"")
+	}
+
+	f.writer = &lumberjack.Logger{
+		Filename:   cfg.Path,
+		MaxSize:    cfg.MaxSizeMB,
+		MaxBackups: cfg.MaxBackups,
+	}
+	return nil
+}
+
+func (f *fileSink) Write(nodeID string, checks []types.HealthCheck) error {
+	line, err := json.Marshal(fileEvent{NodeID: nodeID, Timestamp: time.Now(), Checks: checks})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	_, err = f.writer.Write(line)
+	return err
+}
+
+func (f *fileSink) Close() error {
+	return f.writer.Close()
+}
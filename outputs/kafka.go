@@ -0,0 +1,107 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package outputs
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/IBM/sarama"
+	types "github.com/nomad-node-problem-detector/types"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	Register("kafka", func() Sink { return &kafkaSink{} })
+}
+
+// kafkaConfig configures the "kafka" sink.
+type kafkaConfig struct {
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+}
+
+// kafkaEvent is the JSON payload published for every health check.
+type kafkaEvent struct {
+	NodeID    string            `json:"node_id"`
+	Timestamp time.Time         `json:"timestamp"`
+	Check     types.HealthCheck `json:"check"`
+}
+
+// kafkaSink publishes a JSON event per health check to a Kafka topic, so
+// downstream consumers (alerting, audit, analytics) can subscribe without
+// polling Nomad or NNPD directly.
+type kafkaSink struct {
+	topic    string
+	producer sarama.AsyncProducer
+}
+
+func (k *kafkaSink) Name() string {
+	return "kafka"
+}
+
+func (k *kafkaSink) Init(rawCfg json.RawMessage) error {
+	var cfg kafkaConfig
+	if err := json.Unmarshal(rawCfg, &cfg); err != nil {
+		return err
+	}
+	if len(cfg.Brokers) == 0 || cfg.Topic == "" {
+		return fmt.Errorf("kafka sink requires \"brokers\" and \"topic\"")
+	}
+
+	saramaCfg := sarama.NewConfig()
+	saramaCfg.Producer.Return.Successes = false
+	saramaCfg.Producer.Return.Errors = true
+
+	producer, err := sarama.NewAsyncProducer(cfg.Brokers, saramaCfg)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for err := range producer.Errors() {
+			log.Warning(fmt.Sprintf("Error publishing health event to kafka: %v\n", err))
+		}
+	}()
+
+	k.topic = cfg.Topic
+	k.producer = producer
+	return nil
+}
+
+func (k *kafkaSink) Write(nodeID string, checks []types.HealthCheck) error {
+	now := time.Now()
+	for _, check := range checks {
+		payload, err := json.Marshal(kafkaEvent{NodeID: nodeID, Timestamp: now, Check: check})
+		if err != nil {
+			return err
+		}
+
+		k.producer.Input() <- &sarama.ProducerMessage{
+			Topic: k.topic,
+			Key:   sarama.StringEncoder(nodeID),
+			Value: sarama.ByteEncoder(payload),
+		}
+	}
+	return nil
+}
+
+func (k *kafkaSink) Close() error {
+	return k.producer.Close()
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package outputs implements a pluggable sink subsystem for node health
+// results, modeled after telegraf's output plugins. The aggregator fans out
+// every node's health checks to each configured sink instead of (or in
+// addition to) toggling Nomad node eligibility directly.
+package outputs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	types "github.com/nomad-node-problem-detector/types"
+)
+
+// Sink is a destination for node health results. Implementations are
+// registered by name via Register and instantiated from the aggregator's
+// outputs config.
+type Sink interface {
+	// Name returns the sink's registered name.
+	Name() string
+	// Init configures the sink from its raw JSON config block.
+	Init(cfg json.RawMessage) error
+	// Write delivers a node's current health checks to the sink.
+	Write(nodeID string, checks []types.HealthCheck) error
+	// Close releases any resources held by the sink.
+	Close() error
+}
+
+// Factory constructs a new, unconfigured Sink instance.
+type Factory func() Sink
+
+var (
+	registryLock sync.Mutex
+	registry     = make(map[string]Factory)
+)
+
+// Register adds a sink factory under name. It panics if name is already
+// registered, mirroring database/sql's driver registry.
+func Register(name string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("outputs: Register called twice for sink %q", name))
+	}
+	registry[name] = factory
+}
+
+// New instantiates a registered sink by name.
+func New(name string) (Sink, error) {
+	registryLock.Lock()
+	factory, ok := registry[name]
+	registryLock.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("outputs: no sink registered with name %q", name)
+	}
+	return factory(), nil
+}
+
+// Config describes one configured sink entry in the aggregator's outputs
+// section, e.g. {"name": "prometheus", "config": {...}}.
+type Config struct {
+	Name   string          `json:"name"`
+	Config json.RawMessage `json:"config"`
+}
+
+// Load instantiates and initializes a sink for every entry in configs.
+func Load(configs []Config) ([]Sink, error) {
+	sinks := make([]Sink, 0, len(configs))
+	for _, c := range configs {
+		sink, err := New(c.Name)
+		if err != nil {
+			return nil, err
+		}
+		if err := sink.Init(c.Config); err != nil {
+			return nil, fmt.Errorf("outputs: error initializing sink %q: %v", c.Name, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
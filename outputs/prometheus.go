@@ -0,0 +1,121 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package outputs
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	types "github.com/nomad-node-problem-detector/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func init() {
+	Register("prometheus", func() Sink { return &prometheusSink{} })
+}
+
+// prometheusConfig configures the "prometheus" sink.
+type prometheusConfig struct {
+	// Listen is the address the scrape endpoint listens on, e.g. ":9273".
+	Listen string `json:"listen"`
+	// Path is the scrape endpoint path, defaulting to "/metrics".
+	Path string `json:"path"`
+}
+
+// prometheusSink exposes per-check gauges and state transition counters on a
+// scrape endpoint, so operators can wire NNPD into an existing Prometheus
+// stack instead of relying on Nomad eligibility as the integration point.
+type prometheusSink struct {
+	server *http.Server
+
+	lock     sync.Mutex
+	previous map[string]map[string]string // nodeID -> check type -> last result
+
+	checkState  *prometheus.GaugeVec
+	transitions *prometheus.CounterVec
+}
+
+func (p *prometheusSink) Name() string {
+	return "prometheus"
+}
+
+func (p *prometheusSink) Init(rawCfg json.RawMessage) error {
+	cfg := prometheusConfig{Listen: ":9273", Path: "/metrics"}
+	if len(rawCfg) > 0 {
+		if err := json.Unmarshal(rawCfg, &cfg); err != nil {
+			return err
+		}
+	}
+
+	p.previous = make(map[string]map[string]string)
+
+	registry := prometheus.NewRegistry()
+	checkState := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nnpd_check_state",
+		Help: "Current result of a node health check (1 = unhealthy, 0 = healthy).",
+	}, []string{"node_id", "check_type"})
+	transitions := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nnpd_check_state_transitions_total",
+		Help: "Number of times a node health check's result has changed.",
+	}, []string{"node_id", "check_type"})
+	registry.MustRegister(checkState, transitions)
+
+	p.checkState = checkState
+	p.transitions = transitions
+
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Path, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	p.server = &http.Server{Addr: cfg.Listen, Handler: mux}
+
+	go p.server.ListenAndServe()
+	return nil
+}
+
+func (p *prometheusSink) Write(nodeID string, checks []types.HealthCheck) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	previous, ok := p.previous[nodeID]
+	if !ok {
+		previous = make(map[string]string)
+		p.previous[nodeID] = previous
+	}
+
+	for _, check := range checks {
+		value := 0.0
+		if check.Result == "Unhealthy" || check.Result == "true" {
+			value = 1.0
+		}
+		p.checkState.WithLabelValues(nodeID, check.Type).Set(value)
+
+		if prev, ok := previous[check.Type]; ok && prev != check.Result {
+			p.transitions.WithLabelValues(nodeID, check.Type).Inc()
+		}
+		previous[check.Type] = check.Result
+	}
+	return nil
+}
+
+func (p *prometheusSink) Close() error {
+	if p.server == nil {
+		return nil
+	}
+	return p.server.Close()
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2021 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package outputs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	types "github.com/nomad-node-problem-detector/types"
+)
+
+func init() {
+	Register("webhook", func() Sink { return &webhookSink{} })
+}
+
+// webhookConfig configures the "webhook" sink.
+type webhookConfig struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+// webhookPayload is the JSON body POSTed to the configured URL.
+type webhookPayload struct {
+	NodeID    string              `json:"node_id"`
+	Timestamp time.Time           `json:"timestamp"`
+	Checks    []types.HealthCheck `json:"checks"`
+}
+
+// webhookSink POSTs a node's health checks to an arbitrary HTTP endpoint,
+// signing the body with HMAC-SHA256 so receivers can verify it came from
+// this aggregator.
+type webhookSink struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (w *webhookSink) Name() string {
+	return "webhook"
+}
+
+func (w *webhookSink) Init(rawCfg json.RawMessage) error {
+	var cfg webhookConfig
+	if err := json.Unmarshal(rawCfg, &cfg); err != nil {
+		return err
+	}
+	if cfg.URL == "" {
+		return fmt.Errorf("webhook sink requires \"url\"")
+	}
+
+	w.url = cfg.URL
+	w.secret = cfg.Secret
+	w.client = &http.Client{Timeout: 5 * time.Second}
+	return nil
+}
+
+func (w *webhookSink) Write(nodeID string, checks []types.HealthCheck) error {
+	body, err := json.Marshal(webhookPayload{NodeID: nodeID, Timestamp: time.Now(), Checks: checks})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if w.secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.secret))
+		mac.Write(body)
+		req.Header.Set("X-NNPD-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned status %d", w.url, resp.StatusCode)
+	}
+	return nil
+}
+
+func (w *webhookSink) Close() error {
+	return nil
+}
@@ -1,12 +1,36 @@
 package types
 
+import "encoding/json"
+
 type HealthCheck struct {
 	Type    string `json:"type"`
 	Result  string `json:"result"`
 	Message string `json:"messgae"`
 }
 
+// Config describes one configured health check. HealthCheck is, depending on
+// Kind, a script path, an exec command, a plugin binary, or a URL.
 type Config struct {
 	Type        string `json:"type"`
 	HealthCheck string `json:"health_check"`
-}
\ No newline at end of file
+
+	// Kind selects how HealthCheck is run: "script" (the default, a shell
+	// script whose stdout is the result), "exec" (a command re-invoked each
+	// evaluation with Params piped to stdin as JSON), "grpc" (a long-lived
+	// plugin subprocess speaking the checks.HealthCheck gRPC service), or
+	// "http" (a URL polled for a JSON-encoded HealthCheck body).
+	Kind string `json:"kind"`
+	// Interval overrides how often this check is re-evaluated, independent
+	// of the detector's overall detection-cycle-time. Parsed with
+	// time.ParseDuration; defaults to the detection cycle time if empty.
+	// Ignored by "grpc" checks, which stream updates instead of being
+	// polled.
+	Interval string `json:"interval"`
+	// Timeout bounds a single evaluation of this check. Parsed with
+	// time.ParseDuration; defaults to 5s if empty.
+	Timeout string `json:"timeout"`
+	// Params is passed through verbatim to the check's Kind-specific
+	// runner, e.g. the URL for "http" or the plugin's own config for
+	// "grpc" and "exec".
+	Params json.RawMessage `json:"params"`
+}